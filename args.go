@@ -0,0 +1,102 @@
+package main
+
+import (
+	"runtime"
+	"strconv"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+var (
+	app = kingpin.New("butler", "Your best friend when it comes to pushing builds to itch.io")
+
+	diffArgs = struct {
+		target             *string
+		source             *string
+		patch              *string
+		quality            *int
+		verify             *bool
+		patchUploadURL     *string
+		signatureUploadURL *string
+		chunking           *string
+		workers            *int
+		bsdiff             *bool
+	}{}
+
+	applyArgs = struct {
+		patch   *string
+		target  *string
+		output  *string
+		inplace *bool
+	}{}
+
+	signArgs = struct {
+		output    *string
+		signature *string
+		chunking  *string
+		workers   *int
+	}{}
+
+	verifyArgs = struct {
+		signature *string
+		output    *string
+		workers   *int
+		heal      *string
+	}{}
+)
+
+func init() {
+	{
+		cmd := app.Command("diff", "Generate a patch and signature from two directories, or from a directory and a signature")
+		diffArgs.target = cmd.Arg("target", "Directory, zip archive, or .sig signature file to diff against").Required().String()
+		diffArgs.source = cmd.Arg("source", "Directory or zip archive to diff").Required().String()
+		diffArgs.patch = cmd.Arg("patch", "Path to write the patch to").Required().String()
+		diffArgs.quality = cmd.Flag("quality", "Brotli compression quality, 0-11").Default("1").Int()
+		diffArgs.verify = cmd.Flag("verify", "Verify the produced patch by applying and re-verifying it").Bool()
+		diffArgs.patchUploadURL = cmd.Flag("patch-upload-url", "Stream the patch to this URL instead of writing it to disk").String()
+		diffArgs.signatureUploadURL = cmd.Flag("signature-upload-url", "Stream the signature to this URL instead of writing it to disk").String()
+		diffArgs.chunking = cmd.Flag("chunking", "Chunking mode to use: rsync (default) or cdc").Default("rsync").String()
+		diffArgs.workers = cmd.Flag("workers", "Number of parallel workers to use for signature computation").Default(strconv.Itoa(runtime.NumCPU())).Int()
+		diffArgs.bsdiff = cmd.Flag("bsdiff", "Fall back to a bsdiff-style delta for files with poor block reuse").Bool()
+		cmd.Action(func(pc *kingpin.ParseContext) error {
+			diff(*diffArgs.target, *diffArgs.source, *diffArgs.patch, *diffArgs.quality)
+			return nil
+		})
+	}
+
+	{
+		cmd := app.Command("apply", "Apply a patch to a directory")
+		applyArgs.patch = cmd.Arg("patch", "Patch file to apply").Required().String()
+		applyArgs.target = cmd.Arg("target", "Directory to patch").Required().String()
+		applyArgs.output = cmd.Flag("output", "Directory to write the patched result to, if different from target").String()
+		applyArgs.inplace = cmd.Flag("inplace", "Patch target in place instead of writing to a separate output directory").Bool()
+		cmd.Action(func(pc *kingpin.ParseContext) error {
+			apply(*applyArgs.patch, *applyArgs.target, *applyArgs.output, *applyArgs.inplace)
+			return nil
+		})
+	}
+
+	{
+		cmd := app.Command("sign", "Generate a signature file for a directory")
+		signArgs.output = cmd.Arg("output", "Directory or zip archive to sign").Required().String()
+		signArgs.signature = cmd.Arg("signature", "Path to write the signature to").Required().String()
+		signArgs.chunking = cmd.Flag("chunking", "Chunking mode to use: rsync (default) or cdc").Default("rsync").String()
+		signArgs.workers = cmd.Flag("workers", "Number of parallel workers to use for signature computation").Default(strconv.Itoa(runtime.NumCPU())).Int()
+		cmd.Action(func(pc *kingpin.ParseContext) error {
+			sign(*signArgs.output, *signArgs.signature)
+			return nil
+		})
+	}
+
+	{
+		cmd := app.Command("verify", "Verify a directory against a signature")
+		verifyArgs.signature = cmd.Arg("signature", "Signature file to verify against").Required().String()
+		verifyArgs.output = cmd.Arg("output", "Directory to verify").Required().String()
+		verifyArgs.workers = cmd.Flag("workers", "Number of parallel workers to use for signature computation").Default(strconv.Itoa(runtime.NumCPU())).Int()
+		verifyArgs.heal = cmd.Flag("heal", "Repair mismatched blocks from this HTTP URL or local mirror directory instead of just reporting them").String()
+		cmd.Action(func(pc *kingpin.ParseContext) error {
+			verify(*verifyArgs.signature, *verifyArgs.output)
+			return nil
+		})
+	}
+}
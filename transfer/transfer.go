@@ -0,0 +1,282 @@
+package transfer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/itchio/wharf/counter"
+)
+
+// DefaultChunkSize is used when a ResumableUpload isn't given an explicit one.
+const DefaultChunkSize = 1 * 1024 * 1024 // 1MB
+
+// ResumableUpload is an io.WriteCloser that buffers writes and streams them
+// to a remote HTTP endpoint (e.g. an itch.io build upload URL) in fixed-size
+// chunks, PUT one at a time with a Content-Range header. If a chunk fails to
+// upload, it asks the server how many bytes it actually committed and
+// resumes from there instead of restarting the whole upload.
+type ResumableUpload struct {
+	UploadURL string
+	ChunkSize int64
+	Client    *http.Client
+	// OnProgress, if set, is called with the number of bytes sent so far
+	// while a chunk's body is being uploaded, and with the number of bytes
+	// committed to the remote endpoint after each successful chunk.
+	OnProgress func(committed int64)
+
+	buf    bytes.Buffer
+	offset int64
+	total  int64
+}
+
+// NewResumableUpload returns a ResumableUpload targeting uploadURL, ready to
+// be used as the destination of an io.Copy.
+func NewResumableUpload(uploadURL string) *ResumableUpload {
+	return &ResumableUpload{
+		UploadURL: uploadURL,
+		ChunkSize: DefaultChunkSize,
+		Client:    http.DefaultClient,
+	}
+}
+
+var _ io.WriteCloser = (*ResumableUpload)(nil)
+
+func (ru *ResumableUpload) Write(p []byte) (int, error) {
+	n, err := ru.buf.Write(p)
+	if err != nil {
+		return n, err
+	}
+	ru.total += int64(n)
+
+	for int64(ru.buf.Len()) >= ru.ChunkSize {
+		if err := ru.flush(ru.ChunkSize, false); err != nil {
+			return n, err
+		}
+	}
+
+	return n, nil
+}
+
+// Close flushes any remaining buffered bytes and finalizes the upload.
+func (ru *ResumableUpload) Close() error {
+	return ru.flush(int64(ru.buf.Len()), true)
+}
+
+func (ru *ResumableUpload) flush(size int64, final bool) error {
+	if size == 0 {
+		if !final {
+			return nil
+		}
+		// the last full chunk landed exactly on ru.total: there's nothing
+		// left to send, just tell the server the upload is complete.
+		return ru.finalize()
+	}
+
+	chunk := ru.buf.Next(int(size))
+
+	err := ru.putChunk(chunk, ru.offset, final)
+	if err != nil {
+		committed, cerr := ru.queryCommittedOffset()
+		if cerr != nil {
+			return fmt.Errorf("while retrying upload after %s: %s", err.Error(), cerr.Error())
+		}
+
+		if committed < ru.offset || committed > ru.offset+int64(len(chunk)) {
+			return fmt.Errorf("upload fell out of sync: server committed %d bytes, client was at %d", committed, ru.offset)
+		}
+
+		if committed == ru.offset+int64(len(chunk)) {
+			// the server actually got the whole chunk despite the transport
+			// error; nothing left to resend.
+			ru.offset = committed
+			if ru.OnProgress != nil {
+				ru.OnProgress(ru.offset)
+			}
+			return nil
+		}
+
+		chunk = chunk[committed-ru.offset:]
+		ru.offset = committed
+
+		if err := ru.putChunk(chunk, ru.offset, final); err != nil {
+			return err
+		}
+	}
+
+	ru.offset += int64(len(chunk))
+	if ru.OnProgress != nil {
+		ru.OnProgress(ru.offset)
+	}
+	return nil
+}
+
+func (ru *ResumableUpload) putChunk(chunk []byte, offset int64, final bool) error {
+	var body io.Reader = bytes.NewReader(chunk)
+	if ru.OnProgress != nil {
+		body = counter.NewReaderCallback(func(count int64) {
+			ru.OnProgress(offset + count)
+		}, body)
+	}
+
+	req, err := http.NewRequest("PUT", ru.UploadURL, body)
+	if err != nil {
+		return err
+	}
+
+	total := "*"
+	if final {
+		total = strconv.FormatInt(offset+int64(len(chunk)), 10)
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", offset, offset+int64(len(chunk))-1, total))
+
+	return ru.do(req)
+}
+
+// finalize tells the server the upload's total size, for the case where the
+// last chunk of actual data already landed exactly on a chunk boundary and
+// there are no bytes left to carry the final Content-Range.
+func (ru *ResumableUpload) finalize() error {
+	req, err := http.NewRequest("PUT", ru.UploadURL, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes */%d", ru.offset))
+	req.ContentLength = 0
+
+	return ru.do(req)
+}
+
+func (ru *ResumableUpload) do(req *http.Request) error {
+	res, err := ru.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != 200 && res.StatusCode != 201 && res.StatusCode != 308 {
+		return fmt.Errorf("upload chunk rejected: server responded %s", res.Status)
+	}
+
+	return nil
+}
+
+// queryCommittedOffset asks the upload endpoint how many bytes it has
+// durably received so far, via a zero-length PUT as described by the
+// resumable upload protocol.
+func (ru *ResumableUpload) queryCommittedOffset() (int64, error) {
+	req, err := http.NewRequest("PUT", ru.UploadURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Range", "bytes */*")
+	req.ContentLength = 0
+
+	res, err := ru.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	ioutil.ReadAll(res.Body)
+
+	if res.StatusCode != 308 {
+		return 0, fmt.Errorf("could not query upload offset: server responded %s", res.Status)
+	}
+
+	rangeHeader := res.Header.Get("Range")
+	if rangeHeader == "" {
+		return 0, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(rangeHeader, "bytes="), "-", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("could not parse Range header %q", rangeHeader)
+	}
+
+	committed, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return committed + 1, nil
+}
+
+// ResumableDownload is an io.ReadCloser over a remote HTTP resource that
+// transparently resumes with a Range request if the connection drops
+// mid-read, instead of surfacing the error to the caller.
+type ResumableDownload struct {
+	URL    string
+	Client *http.Client
+
+	offset int64
+	size   int64
+	body   io.ReadCloser
+}
+
+// NewResumableDownload starts streaming url, following redirects and reading
+// the resource's total size from the initial response.
+func NewResumableDownload(url string) (*ResumableDownload, error) {
+	rd := &ResumableDownload{
+		URL:    url,
+		Client: http.DefaultClient,
+	}
+
+	if err := rd.connect(); err != nil {
+		return nil, err
+	}
+
+	return rd, nil
+}
+
+var _ io.ReadCloser = (*ResumableDownload)(nil)
+
+func (rd *ResumableDownload) connect() error {
+	req, err := http.NewRequest("GET", rd.URL, nil)
+	if err != nil {
+		return err
+	}
+	if rd.offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", rd.offset))
+	}
+
+	res, err := rd.Client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	if res.StatusCode != 200 && res.StatusCode != 206 {
+		res.Body.Close()
+		return fmt.Errorf("download rejected: server responded %s", res.Status)
+	}
+
+	if rd.size == 0 {
+		rd.size = res.ContentLength + rd.offset
+	}
+
+	rd.body = res.Body
+	return nil
+}
+
+func (rd *ResumableDownload) Read(p []byte) (int, error) {
+	n, err := rd.body.Read(p)
+	rd.offset += int64(n)
+
+	if err != nil && err != io.EOF && (rd.size == 0 || rd.offset < rd.size) {
+		rd.body.Close()
+		if cerr := rd.connect(); cerr != nil {
+			return n, err
+		}
+		return n, nil
+	}
+
+	return n, err
+}
+
+func (rd *ResumableDownload) Close() error {
+	return rd.body.Close()
+}
@@ -0,0 +1,83 @@
+package transfer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResumableUploadFinalizesOnChunkBoundary(t *testing.T) {
+	var ranges []string
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Content-Range"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer srv.Close()
+
+	ru := NewResumableUpload(srv.URL)
+	ru.ChunkSize = 4
+	ru.Client = srv.Client()
+
+	if _, err := ru.Write([]byte("abcd")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if err := ru.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	want := []string{"bytes 0-3/4", "bytes */4"}
+	if len(ranges) != len(want) {
+		t.Fatalf("got %d requests %v, want %v", len(ranges), ranges, want)
+	}
+	for i, r := range ranges {
+		if r != want[i] {
+			t.Errorf("request %d: got Content-Range %q, want %q", i, r, want[i])
+		}
+	}
+}
+
+func TestResumableUploadSkipsResendWhenServerAlreadyCommitted(t *testing.T) {
+	var puts int
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cr := r.Header.Get("Content-Range")
+		switch {
+		case cr == "bytes 0-3/4":
+			puts++
+			// client sees this as a transport failure even though the
+			// server durably received the chunk
+			w.WriteHeader(http.StatusInternalServerError)
+		case cr == "bytes */*":
+			w.Header().Set("Range", "bytes=0-3")
+			w.WriteHeader(http.StatusPermanentRedirect)
+		default:
+			t.Errorf("unexpected Content-Range %q", cr)
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer srv.Close()
+
+	ru := NewResumableUpload(srv.URL)
+	ru.ChunkSize = 4
+	ru.Client = srv.Client()
+
+	var progressed int64
+	ru.OnProgress = func(committed int64) {
+		progressed = committed
+	}
+
+	if _, err := ru.Write([]byte("abcd")); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	if puts != 1 {
+		t.Fatalf("expected exactly one chunk PUT attempt, got %d", puts)
+	}
+	if ru.offset != 4 {
+		t.Errorf("offset = %d, want 4", ru.offset)
+	}
+	if progressed != 4 {
+		t.Errorf("OnProgress reported %d, want 4", progressed)
+	}
+}
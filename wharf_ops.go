@@ -1,18 +1,25 @@
 package main
 
 import (
+	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
 	"path"
+	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/itchio/butler/comm"
+	"github.com/itchio/butler/transfer"
 	"github.com/itchio/wharf/counter"
+	"github.com/itchio/wharf/eos"
 	"github.com/itchio/wharf/pwr"
 	"github.com/itchio/wharf/sync"
 	"github.com/itchio/wharf/tlc"
 	"github.com/itchio/wharf/wire"
+	"github.com/itchio/wharf/wsync"
 )
 
 func diff(target string, source string, patch string, brotliQuality int) {
@@ -20,6 +27,10 @@ func diff(target string, source string, patch string, brotliQuality int) {
 }
 
 func doDiff(target string, source string, patch string, brotliQuality int) error {
+	if *diffArgs.verify && (*diffArgs.patchUploadURL != "" || *diffArgs.signatureUploadURL != "") {
+		return fmt.Errorf("--verify can't be used with --patch-upload-url or --signature-upload-url, there's no local file to verify against")
+	}
+
 	startTime := time.Now()
 
 	var targetSignature []sync.BlockHash
@@ -28,20 +39,28 @@ func doDiff(target string, source string, patch string, brotliQuality int) error
 	if target == "/dev/null" {
 		targetContainer = &tlc.Container{}
 	} else {
-		targetInfo, err := os.Lstat(target)
+		targetReader, err := eos.Open(target)
+		if err != nil {
+			return err
+		}
+
+		targetInfo, err := targetReader.Stat()
 		if err != nil {
+			targetReader.Close()
 			return err
 		}
 
-		if targetInfo.IsDir() {
+		if targetInfo.IsDir() || strings.HasSuffix(strings.ToLower(target), ".zip") {
+			targetReader.Close()
+
 			comm.Opf("Hashing %s", target)
-			targetContainer, err = tlc.Walk(target, filterPaths)
+			targetContainer, err = tlc.WalkAny(target, filterPaths)
 			if err != nil {
 				return err
 			}
 
 			comm.StartProgress()
-			targetSignature, err = pwr.ComputeSignature(targetContainer, target, comm.NewStateConsumer())
+			targetSignature, err = pwr.ComputeSignatureParallel(targetContainer, target, comm.NewStateConsumer(), *diffArgs.workers)
 			comm.EndProgress()
 			if err != nil {
 				return err
@@ -54,15 +73,12 @@ func doDiff(target string, source string, patch string, brotliQuality int) error
 			}
 		} else {
 			comm.Opf("Reading signature from %s", target)
-			signatureReader, err := os.Open(target)
-			if err != nil {
-				return err
-			}
-			targetContainer, targetSignature, err = pwr.ReadSignature(signatureReader)
+			targetContainer, targetSignature, err = pwr.ReadSignature(targetReader)
 			if err != nil {
+				targetReader.Close()
 				return err
 			}
-			err = signatureReader.Close()
+			err = targetReader.Close()
 			if err != nil {
 				return err
 			}
@@ -77,28 +93,51 @@ func doDiff(target string, source string, patch string, brotliQuality int) error
 		sourceContainer = &tlc.Container{}
 	} else {
 		var err error
-		sourceContainer, err = tlc.Walk(source, filterPaths)
+		sourceContainer, err = tlc.WalkAny(source, filterPaths)
 		if err != nil {
 			return err
 		}
 	}
 
-	patchWriter, err := os.Create(patch)
-	if err != nil {
-		return err
+	var err error
+
+	var patchWriter io.WriteCloser
+	if *diffArgs.patchUploadURL != "" {
+		comm.Opf("Streaming patch to upload URL")
+		upload := transfer.NewResumableUpload(*diffArgs.patchUploadURL)
+		upload.OnProgress = func(committed int64) {
+			comm.Progress(float64(committed) / float64(sourceContainer.Size))
+		}
+		patchWriter = upload
+	} else {
+		patchWriter, err = eos.Create(patch)
+		if err != nil {
+			return err
+		}
 	}
 	defer patchWriter.Close()
 
 	signaturePath := patch + ".sig"
-	signatureWriter, err := os.Create(signaturePath)
-	if err != nil {
-		return err
+	var signatureWriter io.WriteCloser
+	if *diffArgs.signatureUploadURL != "" {
+		comm.Opf("Streaming signature to upload URL")
+		signatureWriter = transfer.NewResumableUpload(*diffArgs.signatureUploadURL)
+	} else {
+		signatureWriter, err = eos.Create(signaturePath)
+		if err != nil {
+			return err
+		}
 	}
 	defer signatureWriter.Close()
 
 	patchCounter := counter.NewWriter(patchWriter)
 	signatureCounter := counter.NewWriter(signatureWriter)
 
+	chunking, err := parseChunkingAlgorithm(*diffArgs.chunking)
+	if err != nil {
+		return err
+	}
+
 	dctx := &pwr.DiffContext{
 		SourceContainer: sourceContainer,
 		SourcePath:      source,
@@ -111,6 +150,15 @@ func doDiff(target string, source string, patch string, brotliQuality int) error
 			Algorithm: pwr.CompressionAlgorithm_BROTLI,
 			Quality:   int32(*diffArgs.quality),
 		},
+		Chunking: &pwr.ChunkingSettings{
+			Algorithm: chunking,
+			MinSize:   16 * 1024,
+			AvgSize:   64 * 1024,
+			MaxSize:   256 * 1024,
+		},
+
+		UseBsdiff:       *diffArgs.bsdiff,
+		BsdiffThreshold: 0.3,
 	}
 
 	comm.Opf("Diffing %s", source)
@@ -172,10 +220,17 @@ func doApply(patch string, target string, output string, inplace bool) error {
 	comm.Opf("Patching %s", output)
 	startTime := time.Now()
 
-	patchReader, err := os.Open(patch)
+	var patchReader io.ReadCloser
+	var err error
+	if strings.HasPrefix(patch, "http://") || strings.HasPrefix(patch, "https://") {
+		patchReader, err = transfer.NewResumableDownload(patch)
+	} else {
+		patchReader, err = eos.Open(patch)
+	}
 	if err != nil {
 		return err
 	}
+	defer patchReader.Close()
 
 	actx := &pwr.ApplyContext{
 		TargetPath: target,
@@ -208,23 +263,34 @@ func doSign(output string, signature string) error {
 	comm.Opf("Creating signature for %s", output)
 	startTime := time.Now()
 
-	container, err := tlc.Walk(output, filterPaths)
+	container, err := tlc.WalkAny(output, filterPaths)
 	if err != nil {
 		return err
 	}
 
-	signatureWriter, err := os.Create(signature)
+	signatureWriter, err := eos.Create(signature)
 	if err != nil {
 		return err
 	}
 
 	compression := pwr.CompressionDefault()
 
+	chunking, err := parseChunkingAlgorithm(*signArgs.chunking)
+	if err != nil {
+		return err
+	}
+
 	rawSigWire := wire.NewWriteContext(signatureWriter)
 	rawSigWire.WriteMagic(pwr.SignatureMagic)
 
 	rawSigWire.WriteMessage(&pwr.SignatureHeader{
 		Compression: compression,
+		Chunking: &pwr.ChunkingSettings{
+			Algorithm: chunking,
+			MinSize:   16 * 1024,
+			AvgSize:   64 * 1024,
+			MaxSize:   256 * 1024,
+		},
 	})
 
 	sigWire, err := pwr.CompressWire(rawSigWire, compression)
@@ -234,7 +300,7 @@ func doSign(output string, signature string) error {
 	sigWire.WriteMessage(container)
 
 	comm.StartProgress()
-	err = pwr.ComputeSignatureToWriter(container, output, comm.NewStateConsumer(), func(hash sync.BlockHash) error {
+	err = pwr.ComputeSignatureToWriterParallel(container, output, comm.NewStateConsumer(), *signArgs.workers, func(hash sync.BlockHash) error {
 		return sigWire.WriteMessage(&pwr.BlockHash{
 			WeakHash:   hash.WeakHash,
 			StrongHash: hash.StrongHash,
@@ -265,7 +331,7 @@ func doVerify(signature string, output string) error {
 	comm.Opf("Verifying %s", output)
 	startTime := time.Now()
 
-	signatureReader, err := os.Open(signature)
+	signatureReader, err := eos.Open(signature)
 	if err != nil {
 		return err
 	}
@@ -277,16 +343,31 @@ func doVerify(signature string, output string) error {
 	}
 
 	comm.StartProgress()
-	hashes, err := pwr.ComputeSignature(refContainer, output, comm.NewStateConsumer())
+	hashes, err := pwr.ComputeSignatureParallel(refContainer, output, comm.NewStateConsumer(), *verifyArgs.workers)
 	comm.EndProgress()
 	if err != nil {
 		return err
 	}
 
-	err = pwr.CompareHashes(refHashes, hashes)
-	if err != nil {
-		comm.Logf(err.Error())
-		comm.Dief("Some checks failed after checking %d block.", len(refHashes))
+	if *verifyArgs.heal != "" {
+		mismatches, err := pwr.DiffHashes(refHashes, hashes)
+		if err != nil {
+			return err
+		}
+
+		if len(mismatches) > 0 {
+			comm.Opf("Healing %d mismatched block(s) from %s", len(mismatches), *verifyArgs.heal)
+			err = healBlocks(*verifyArgs.heal, refContainer, output, mismatches)
+			if err != nil {
+				return err
+			}
+		}
+	} else {
+		err = pwr.CompareHashes(refHashes, hashes)
+		if err != nil {
+			comm.Logf(err.Error())
+			comm.Dief("Some checks failed after checking %d block.", len(refHashes))
+		}
 	}
 
 	prettySize := humanize.Bytes(uint64(refContainer.Size))
@@ -295,3 +376,95 @@ func doVerify(signature string, output string) error {
 
 	return nil
 }
+
+// healBlocks fetches the blocks listed in mismatches from healSpec (an HTTP
+// URL or a local mirror directory) and rewrites them in place under outputPath.
+func healBlocks(healSpec string, refContainer *tlc.Container, outputPath string, mismatches []sync.BlockHash) error {
+	pool, err := wsync.NewPool(refContainer, healSpec)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	byFile := make(map[int64][]sync.BlockHash)
+	for _, bh := range mismatches {
+		byFile[bh.FileIndex] = append(byFile[bh.FileIndex], bh)
+	}
+
+	var bytesHealed int64
+
+	for fileIndex, blocks := range byFile {
+		file := refContainer.Files[fileIndex]
+
+		reader, err := pool.GetReadSeeker(fileIndex)
+		if err != nil {
+			return err
+		}
+
+		filePath := filepath.Join(outputPath, file.Path)
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+
+		var fileHealed int64
+		for _, bh := range blocks {
+			// Offset/Size come straight from the signature, so this holds for
+			// both fixed rsync blocks and variable-length CDC chunks.
+			blockSize := bh.Size
+			if blockSize == 0 {
+				blockSize = file.Size - bh.Offset
+				if blockSize > int64(pwr.BlockSize) {
+					blockSize = int64(pwr.BlockSize)
+				}
+			}
+			if blockSize <= 0 {
+				f.Close()
+				return fmt.Errorf("heal: invalid block size %d for %s at offset %d", blockSize, file.Path, bh.Offset)
+			}
+
+			if _, err := reader.Seek(bh.Offset, io.SeekStart); err != nil {
+				f.Close()
+				return err
+			}
+
+			buf := make([]byte, blockSize)
+			if _, err := io.ReadFull(reader, buf); err != nil {
+				f.Close()
+				return err
+			}
+
+			if _, err := f.WriteAt(buf, bh.Offset); err != nil {
+				f.Close()
+				return err
+			}
+
+			fileHealed += blockSize
+		}
+		f.Close()
+
+		reused := file.Size - fileHealed
+		comm.Statf("%s: healed %s, reused %s", file.Path, humanize.Bytes(uint64(fileHealed)), humanize.Bytes(uint64(reused)))
+		bytesHealed += fileHealed
+	}
+
+	comm.Statf("Healed %s total", humanize.Bytes(uint64(bytesHealed)))
+
+	return nil
+}
+
+// parseChunkingAlgorithm maps the --chunking flag value to a pwr.ChunkingAlgorithm.
+func parseChunkingAlgorithm(name string) (pwr.ChunkingAlgorithm, error) {
+	switch name {
+	case "", "rsync":
+		return pwr.ChunkingAlgorithm_RSYNC, nil
+	case "cdc":
+		return pwr.ChunkingAlgorithm_CDC, nil
+	default:
+		return pwr.ChunkingAlgorithm_RSYNC, fmt.Errorf("unknown chunking algorithm %q, must be one of: rsync, cdc", name)
+	}
+}